@@ -17,70 +17,316 @@ limitations under the License.
 package github
 
 import (
+	"crypto/rsa"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"k8s.io/kubernetes/pkg/util"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/golang/glog"
 	"github.com/google/go-github/github"
 	"github.com/gregjones/httpcache"
+	"github.com/gregjones/httpcache/diskcache"
 	"golang.org/x/oauth2"
 )
 
 var (
 	useMemoryCache = flag.Bool("use-http-cache", false, "If true, use a client side HTTP cache for API requests.")
+	httpCacheDir   = flag.String("http-cache-dir", "", "If set, cache API responses to this directory so ETags survive a restart. Implies -use-http-cache.")
 )
 
 const (
 	NeedsOKToMergeLabel = "needs-ok-to-merge"
+
+	// rateLimitRemainingFloor is the default X-RateLimit-Remaining level
+	// below which RateLimitRoundTripper pauses until the window resets.
+	rateLimitRemainingFloor = 50
+
+	// secondaryLimitBaseBackoff and secondaryLimitMaxBackoff bound the
+	// exponential backoff RateLimitRoundTripper applies across consecutive
+	// secondary rate limit hits, growing 1m, 2m, 4m, ... up to the cap.
+	secondaryLimitBaseBackoff = time.Minute
+	secondaryLimitMaxBackoff  = 30 * time.Minute
 )
 
+// RateLimitRoundTripper paces requests with a local token bucket, and also
+// tracks GitHub's own primary and secondary rate limits from response
+// headers so we can back off before GitHub starts rejecting requests
+// outright. It is placed underneath any HTTP cache transport so that it
+// sees the real response GitHub sent -- including a bare 304 Not Modified,
+// which GitHub does not count against the primary rate limit, so we don't
+// need to slow down because of one.
 type RateLimitRoundTripper struct {
 	delegate http.RoundTripper
 	throttle util.RateLimiter
+
+	// RemainingFloor is the X-RateLimit-Remaining level below which we
+	// pause until X-RateLimit-Reset. Defaults to rateLimitRemainingFloor.
+	RemainingFloor int
+
+	mu                 sync.Mutex
+	pausedUnto         time.Time
+	secondaryLimitHits int
 }
 
 func (r *RateLimitRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	r.waitOutPause()
+	resp, err = r.delegate.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		// A conditional request GitHub answered with 304 doesn't count
+		// against the primary rate limit, so don't charge the token bucket
+		// for it either -- only requests that actually spend quota pace
+		// themselves against it.
+		return resp, nil
+	}
 	r.throttle.Accept()
-	return r.delegate.RoundTrip(req)
+	r.recordLimits(resp)
+	if resp.StatusCode == http.StatusForbidden {
+		r.backOffSecondaryLimit(resp)
+	} else {
+		r.mu.Lock()
+		r.secondaryLimitHits = 0
+		r.mu.Unlock()
+	}
+	return resp, nil
+}
+
+func (r *RateLimitRoundTripper) waitOutPause() {
+	r.mu.Lock()
+	until := r.pausedUnto
+	r.mu.Unlock()
+	if wait := until.Sub(time.Now()); wait > 0 {
+		glog.Infof("Approaching GitHub rate limit, pausing for %v", wait)
+		time.Sleep(wait)
+	}
+}
+
+// recordLimits reads X-RateLimit-Remaining/-Reset and, if we're close to
+// exhausting the primary rate limit, pauses all further requests until the
+// window resets.
+func (r *RateLimitRoundTripper) recordLimits(resp *http.Response) {
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	floor := r.RemainingFloor
+	if floor <= 0 {
+		floor = rateLimitRemainingFloor
+	}
+	if remaining >= floor {
+		return
+	}
+	resetUnix, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	r.pausedUnto = time.Unix(resetUnix, 0)
+	r.mu.Unlock()
+	glog.Warningf("X-RateLimit-Remaining is %d, pausing until %s", remaining, r.pausedUnto)
+}
+
+// backOffSecondaryLimit honors Retry-After on a 403 secondary-rate-limit
+// response, pausing further requests until it elapses. Consecutive hits
+// (no response other than a 403 or a 304 in between) grow the pause
+// exponentially -- 1m, 2m, 4m, ... up to secondaryLimitMaxBackoff -- and
+// that growing pause is a floor: a Retry-After is used only when it is
+// longer, and the growing pause alone applies when there is none.
+func (r *RateLimitRoundTripper) backOffSecondaryLimit(resp *http.Response) {
+	r.mu.Lock()
+	r.secondaryLimitHits++
+	hits := r.secondaryLimitHits
+	r.mu.Unlock()
+
+	wait := secondaryLimitBaseBackoff * time.Duration(1<<uint(hits-1))
+	if wait > secondaryLimitMaxBackoff {
+		wait = secondaryLimitMaxBackoff
+	}
+	if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		if retryAfterDuration := time.Duration(retryAfter) * time.Second; retryAfterDuration > wait {
+			wait = retryAfterDuration
+		}
+	}
+
+	r.mu.Lock()
+	r.pausedUnto = time.Now().Add(wait)
+	r.mu.Unlock()
+	glog.Warningf("Hit secondary rate limit (%d in a row), backing off for %v", hits, wait)
+}
+
+// cachingTransport wraps delegate with a client-side HTTP cache if
+// -use-http-cache or -http-cache-dir is set, so conditional GETs can be
+// answered with If-None-Match and a 304. If -http-cache-dir is set, the
+// cache is backed by disk so it survives a restart; otherwise it's an
+// in-memory cache that doesn't.
+func cachingTransport(delegate http.RoundTripper) http.RoundTripper {
+	var cache httpcache.Cache
+	switch {
+	case len(*httpCacheDir) > 0:
+		cache = diskcache.New(*httpCacheDir)
+	case *useMemoryCache:
+		cache = httpcache.NewMemoryCache()
+	default:
+		return delegate
+	}
+	return &httpcache.Transport{Transport: delegate, Cache: cache, MarkCachedResponses: true}
 }
 
 func MakeClient(token string) *github.Client {
 	var client *http.Client
-	var transport http.RoundTripper
-	if *useMemoryCache {
-		transport = httpcache.NewMemoryCacheTransport()
-	} else {
-		transport = http.DefaultTransport
-	}
 	if len(token) > 0 {
 		rateLimitTransport := &RateLimitRoundTripper{
-			delegate: transport,
+			delegate: http.DefaultTransport,
 			// Global limit is 5000 Q/Hour, try to only use 1800 to make room for other apps
 			throttle: util.NewTokenBucketRateLimiter(0.5, 10),
 		}
 		ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
 		client = &http.Client{
 			Transport: &oauth2.Transport{
-				Base:   rateLimitTransport,
+				Base:   cachingTransport(rateLimitTransport),
 				Source: oauth2.ReuseTokenSource(nil, ts),
 			},
 		}
 	} else {
 		rateLimitTransport := &RateLimitRoundTripper{
-			delegate: transport,
+			delegate: http.DefaultTransport,
 			throttle: util.NewTokenBucketRateLimiter(0.01, 10),
 		}
 		client = &http.Client{
-			Transport: rateLimitTransport,
+			Transport: cachingTransport(rateLimitTransport),
 		}
 	}
 	return github.NewClient(client)
 }
 
+// appInstallationTransport mints short-lived installation tokens for a
+// GitHub App and refreshes them transparently, so callers never have to
+// think about token expiry. It wraps a RateLimitRoundTripper the same way
+// the oauth2.Transport does for MakeClient, since installation tokens are
+// still subject to the installation's rate limit.
+type appInstallationTransport struct {
+	appID          int64
+	installationID int64
+	privateKey     *rsa.PrivateKey
+	delegate       http.RoundTripper
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (t *appInstallationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.installationToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to mint installation token: %v", err)
+	}
+	req = cloneRequest(req)
+	req.Header.Set("Authorization", "token "+token)
+	return t.delegate.RoundTrip(req)
+}
+
+// installationToken returns a cached installation token, refreshing it if
+// it is missing or within a minute of expiring.
+func (t *appInstallationTransport) installationToken() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.token) > 0 && time.Now().Before(t.expires.Add(-1*time.Minute)) {
+		return t.token, nil
+	}
+	jwtToken, err := t.signAppJWT()
+	if err != nil {
+		return "", err
+	}
+	url := fmt.Sprintf("https://api.github.com/app/installations/%d/access_tokens", t.installationID)
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwtToken)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("unexpected status %s minting installation token", resp.Status)
+	}
+	var result struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	t.token = result.Token
+	t.expires = result.ExpiresAt
+	return t.token, nil
+}
+
+// signAppJWT mints a short-lived JWT identifying the App itself, used only
+// to authenticate the access-token exchange, per
+// https://developer.github.com/apps/building-github-apps/authenticating-with-github-apps/
+func (t *appInstallationTransport) signAppJWT() (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": t.appID,
+		// Backdate iat by a minute to tolerate clock drift between us and
+		// GitHub; otherwise a clock even slightly ahead of GitHub's gets
+		// "'iat' claim is in the future" rejections intermittently.
+		"iat": now.Add(-1 * time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	return token.SignedString(t.privateKey)
+}
+
+func cloneRequest(req *http.Request) *http.Request {
+	clone := new(http.Request)
+	*clone = *req
+	clone.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		vv := make([]string, len(v))
+		copy(vv, v)
+		clone.Header[k] = vv
+	}
+	return clone
+}
+
+// MakeAppClient builds a github.Client that authenticates as a GitHub App
+// installation rather than as a single OAuth user. This lets the bot run
+// against the App's per-installation rate limit (~5000/hour each) instead
+// of sharing one user token across every project it services.
+func MakeAppClient(appID, installationID int64, privateKeyPEM []byte) (*github.Client, error) {
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(privateKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse GitHub App private key: %v", err)
+	}
+	rateLimitTransport := &RateLimitRoundTripper{
+		delegate: http.DefaultTransport,
+		// Installations get their own 5000 Q/Hour limit, so we can run
+		// much closer to it than the shared-token client does.
+		throttle: util.NewTokenBucketRateLimiter(1.0, 10),
+	}
+	appTransport := &appInstallationTransport{
+		appID:          appID,
+		installationID: installationID,
+		privateKey:     privateKey,
+		delegate:       cachingTransport(rateLimitTransport),
+	}
+	client := &http.Client{Transport: appTransport}
+	return github.NewClient(client), nil
+}
+
 func HasLabel(labels []github.Label, name string) bool {
 	for i := range labels {
 		label := &labels[i]
@@ -214,8 +460,78 @@ type FilterConfig struct {
 	E2EStatusContext       string
 	RequiredStatusContexts []string
 
-	// Private, cached
-	userWhitelist util.StringSet
+	// MergeMethod is passed through to the merge API call ("merge",
+	// "squash" or "rebase"). Defaults to "merge" if empty.
+	MergeMethod string
+
+	// AllowUnstableMerge controls what happens when GitHub reports
+	// pr.MergeableState == "unstable" (required contexts passed, but some
+	// non-required context is still failing/pending). If false, unstable
+	// PRs are skipped without a comment; if true, they are treated like
+	// "clean".
+	AllowUnstableMerge bool
+
+	// MergeableUnknownRetries/MergeableUnknownBackoff control how long we
+	// wait for GitHub to compute mergeability when MergeableState is
+	// "unknown", instead of a single fixed sleep.
+	MergeableUnknownRetries int
+	MergeableUnknownBackoff time.Duration
+
+	// BlockedUsers are authors whose PRs are skipped outright: no
+	// needs-ok-to-merge label, no comment, no status evaluation.
+	BlockedUsers []string
+
+	// If true, PRs from a blocked author are also closed automatically.
+	CloseBlockedAuthorPRs bool
+
+	// StalePendingAfter is how long a PR may sit in the "pending" status
+	// state before ReportPendingCI calls it out as stuck.
+	StalePendingAfter time.Duration
+
+	// Private, cached. Guarded by mu since webhook mode can evaluate PRs
+	// concurrently with the polling loop (and with itself, under multiple
+	// simultaneous webhook deliveries).
+	mu             sync.RWMutex
+	userWhitelist  util.StringSet
+	blockedUserSet util.StringSet
+}
+
+// whitelist returns the cached user whitelist, or nil if it hasn't been
+// populated yet.
+func (config *FilterConfig) whitelist() util.StringSet {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+	return config.userWhitelist
+}
+
+// blocklist returns the cached blocklist, or nil if it hasn't been
+// populated yet.
+func (config *FilterConfig) blocklist() util.StringSet {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+	return config.blockedUserSet
+}
+
+// mergeMethod returns config.MergeMethod, defaulting to "merge".
+func (config *FilterConfig) mergeMethod() string {
+	if len(config.MergeMethod) == 0 {
+		return "merge"
+	}
+	return config.MergeMethod
+}
+
+// Merge merges pr using config.MergeMethod ("merge", "squash" or "rebase",
+// defaulting to "merge"). If config.DryRun is true, it logs what it would
+// have done and returns without making the mutating API call.
+func (config *FilterConfig) Merge(client *github.Client, user, project string, pr *github.PullRequest) (*github.PullRequestMergeResult, error) {
+	if config.DryRun {
+		glog.Infof("PR %d: would have merged with method %q but DryRun is true", *pr.Number, config.mergeMethod())
+		return nil, nil
+	}
+	result, _, err := client.PullRequests.Merge(user, project, *pr.Number, "", &github.PullRequestOptions{
+		MergeMethod: config.mergeMethod(),
+	})
+	return result, err
 }
 
 func lastModifiedTime(client *github.Client, user, project string, pr *github.PullRequest) (*time.Time, error) {
@@ -233,6 +549,43 @@ func lastModifiedTime(client *github.Client, user, project string, pr *github.Pu
 	return lastModified, nil
 }
 
+// waitForMergeableState returns the PR's github.MergeableState, refreshing
+// the PR and retrying with a backoff while it is "unknown" (github computes
+// mergeability asynchronously and may not have it ready yet). It gives up
+// after config.MergeableUnknownRetries attempts (default 1) and returns the
+// last state seen, with a state still "unknown" returned as "".
+func waitForMergeableState(client *github.Client, user, project string, pr *github.PullRequest, config *FilterConfig) (*github.PullRequest, string, error) {
+	retries := config.MergeableUnknownRetries
+	if retries <= 0 {
+		retries = 1
+	}
+	backoff := config.MergeableUnknownBackoff
+	if backoff <= 0 {
+		backoff = 10 * time.Second
+	}
+	state := ""
+	if pr.MergeableState != nil {
+		state = *pr.MergeableState
+	}
+	for attempt := 0; (state == "" || state == "unknown") && attempt < retries; attempt++ {
+		glog.Infof("Waiting for mergeability on %s %d", *pr.Title, *pr.Number)
+		time.Sleep(backoff)
+		refreshed, _, err := client.PullRequests.Get(user, project, *pr.Number)
+		if err != nil {
+			return pr, state, err
+		}
+		pr = refreshed
+		state = ""
+		if pr.MergeableState != nil {
+			state = *pr.MergeableState
+		}
+	}
+	if state == "unknown" {
+		state = ""
+	}
+	return pr, state, nil
+}
+
 func GetAllEventsForPR(client *github.Client, user, project string, prNumber int) ([]github.IssueEvent, error) {
 	events := []github.IssueEvent{}
 	page := 1
@@ -317,10 +670,108 @@ func (config *FilterConfig) RefreshWhitelist(client *github.Client, user, projec
 	} else {
 		userSet.Insert(usersWithCommit...)
 	}
+	config.mu.Lock()
 	config.userWhitelist = userSet
+	config.mu.Unlock()
+	return userSet
+}
+
+// RefreshBlocklist updates the blocklist from the config's static
+// BlockedUsers plus the membership of the "blocked-contributors" team, if
+// one exists for the org. This lets ops manage repeat-offender blocking via
+// team membership instead of redeploying the bot.
+func (config *FilterConfig) RefreshBlocklist(client *github.Client, org string) util.StringSet {
+	userSet := util.StringSet{}
+	userSet.Insert(config.BlockedUsers...)
+
+	teams, err := fetchAllTeams(client, org)
+	if err != nil {
+		glog.Errorf("Failed to list teams while refreshing blocklist: %v", err)
+		config.mu.Lock()
+		config.blockedUserSet = userSet
+		config.mu.Unlock()
+		return userSet
+	}
+	for ix := range teams {
+		team := &teams[ix]
+		if team.Name == nil || *team.Name != "blocked-contributors" {
+			continue
+		}
+		users, err := fetchAllUsers(client, *team.ID)
+		if err != nil {
+			glog.Errorf("Failed to list 'blocked-contributors' team members: %v", err)
+			break
+		}
+		for _, user := range users {
+			userSet.Insert(*user.Login)
+		}
+		break
+	}
+	config.mu.Lock()
+	config.blockedUserSet = userSet
+	config.mu.Unlock()
 	return userSet
 }
 
+// candidateGate classifies whether an issue is a gated candidate PR. It is
+// shared between evaluatePR's merge path and ReportPendingCI's read-only
+// notifier path, so a future change to the gating rules (a new skip
+// condition, a change to how WhitelistOverride interacts with labels)
+// can't apply to one without the other.
+type candidateGate int
+
+const (
+	candidateOK candidateGate = iota
+	candidateNotOpen
+	candidateNoUserInfo
+	candidateBlocked
+	candidateBelowMinPR
+	candidateMissingLabels
+	candidateNeedsWhitelist
+)
+
+// ensureUserSets populates config's cached whitelist/blocklist if they
+// haven't been loaded yet.
+func ensureUserSets(client *github.Client, user, project string, config *FilterConfig) {
+	if config.whitelist() == nil {
+		config.RefreshWhitelist(client, user, project)
+	}
+	if config.blocklist() == nil {
+		config.RefreshBlocklist(client, user)
+	}
+}
+
+// gateCandidatePR decides whether issue is a candidate worth evaluating
+// further. It makes no mutating API calls itself; callers decide what (if
+// anything) to do about a non-candidateOK result.
+func gateCandidatePR(issue *github.Issue, config *FilterConfig) candidateGate {
+	if issue.State == nil || *issue.State != "open" {
+		// ForEachCandidatePRDo's listing is already open-only, but
+		// EvaluatePR fetches by number with no such filter, so a webhook
+		// redelivery (a GitHub retry, or a late check_run/issue_comment
+		// event) arriving after the PR merged or closed must be caught
+		// here rather than relying on a closed PR eventually failing to
+		// report a mergeable state.
+		return candidateNotOpen
+	}
+	if issue.User == nil || issue.User.Login == nil {
+		return candidateNoUserInfo
+	}
+	if config.blocklist().Has(*issue.User.Login) {
+		return candidateBlocked
+	}
+	if issue.Number == nil || *issue.Number < config.MinPRNumber {
+		return candidateBelowMinPR
+	}
+	if !HasLabels(issue.Labels, []string{"lgtm", "cla: yes"}) {
+		return candidateMissingLabels
+	}
+	if !HasLabel(issue.Labels, config.WhitelistOverride) && !config.whitelist().Has(*issue.User.Login) {
+		return candidateNeedsWhitelist
+	}
+	return candidateOK
+}
+
 // For each PR in the project that matches:
 //   * pr.Number > minPRNumber
 //   * is mergeable
@@ -334,124 +785,179 @@ func ForEachCandidatePRDo(client *github.Client, user, project string, fn PRFunc
 		return err
 	}
 
-	if config.userWhitelist == nil {
-		config.RefreshWhitelist(client, user, project)
-	}
-
-	userSet := config.userWhitelist
-
 	for ix := range issues {
 		issue := &issues[ix]
-		if issue.User == nil || issue.User.Login == nil {
-			glog.V(2).Infof("Skipping PR %d with no user info %#v.", *issue.Number, issue.User)
-			continue
-		}
-		if *issue.Number < config.MinPRNumber {
-			glog.V(6).Infof("Dropping %d < %d", *issue.Number, config.MinPRNumber)
+		if issue.Number == nil {
 			continue
 		}
 		glog.V(2).Infof("----==== %d ====----", *issue.Number)
-
-		glog.V(8).Infof("%v", issue.Labels)
-		if !HasLabels(issue.Labels, []string{"lgtm", "cla: yes"}) {
-			glog.V(2).Infof("Skipping %d - doesn't have requisite labels", *issue.Number)
-			continue
+		if err := evaluatePR(client, user, project, issue, config, fn); err != nil {
+			glog.Errorf("Failed to run user function: %v", err)
+			break
 		}
-
-		pr, _, err := client.PullRequests.Get(user, project, *issue.Number)
-		if err != nil {
-			glog.Errorf("Error getting pull request: %v", err)
-			continue
+		if once {
+			break
 		}
+	}
+	return nil
+}
 
-		if !HasLabel(issue.Labels, config.WhitelistOverride) && !userSet.Has(*pr.User.Login) {
-			glog.V(4).Infof("Dropping %d since %s isn't in whitelist and %s isn't present", *pr.Number, *pr.User.Login, config.WhitelistOverride)
-			if config.DryRun {
-				glog.Infof("PR %d: would have asked for ok-to-merge but DryRun is true", *pr.Number)
-				continue
-			}
-			if !HasLabel(issue.Labels, NeedsOKToMergeLabel) {
-				if _, _, err := client.Issues.AddLabelsToIssue(user, project, *pr.Number, []string{NeedsOKToMergeLabel}); err != nil {
-					glog.Errorf("Failed to set 'needs-ok-to-merge' for %d", *pr.Number)
-				}
-				body := "The author of this PR is not in the whitelist for merge, can one of the admins add the 'ok-to-merge' label?"
-				if _, _, err := client.Issues.CreateComment(user, project, *pr.Number, &github.IssueComment{Body: &body}); err != nil {
-					glog.Errorf("Failed to add a comment for %d", *pr.Number)
-				}
-			}
-			continue
-		}
+// EvaluatePR fetches issue prNumber and runs it through the candidate-PR
+// gate. It's the entry point for callers that only have a PR number, such
+// as the webhook handler in github/webhook; ForEachCandidatePRDo already
+// has the issue in hand from its label-filtered listing and calls
+// evaluatePR directly to avoid fetching it a second time.
+func EvaluatePR(client *github.Client, user, project string, prNumber int, config *FilterConfig, fn PRFunction) error {
+	issue, _, err := client.Issues.Get(user, project, prNumber)
+	if err != nil {
+		glog.Errorf("Error getting issue %d: %v", prNumber, err)
+		return nil
+	}
+	return evaluatePR(client, user, project, issue, config, fn)
+}
 
-		// Tidy up the issue list.
-		if HasLabel(issue.Labels, NeedsOKToMergeLabel) && !config.DryRun {
-			if _, err := client.Issues.RemoveLabelForIssue(user, project, *pr.Number, NeedsOKToMergeLabel); err != nil {
-				glog.Warningf("Failed to remove 'needs-ok-to-merge' from issue %d, which doesn't need it", *pr.Number)
+// evaluatePR runs the full candidate-PR gate (blocklist, whitelist, labels,
+// LGTM-after-push, mergeability, required status contexts) against a single
+// PR and, if it passes, merges it and invokes fn. It returns a non-nil
+// error only if the merge or fn itself fails; any gate that causes the PR
+// to be skipped is logged and reported as a nil error.
+func evaluatePR(client *github.Client, user, project string, issue *github.Issue, config *FilterConfig, fn PRFunction) error {
+	prNumber := *issue.Number
+	ensureUserSets(client, user, project, config)
+
+	glog.V(8).Infof("%v", issue.Labels)
+	switch gateCandidatePR(issue, config) {
+	case candidateNotOpen:
+		glog.V(6).Infof("Skipping %d - not open", prNumber)
+		return nil
+	case candidateNoUserInfo:
+		glog.V(2).Infof("Skipping PR %d with no user info %#v.", prNumber, issue.User)
+		return nil
+	case candidateBlocked:
+		glog.V(2).Infof("Skipping %d - author %s is blocked", prNumber, *issue.User.Login)
+		if config.CloseBlockedAuthorPRs && !config.DryRun {
+			closed := "closed"
+			if _, _, err := client.Issues.Edit(user, project, prNumber, &github.IssueRequest{State: &closed}); err != nil {
+				glog.Errorf("Failed to close PR %d from blocked author %s: %v", prNumber, *issue.User.Login, err)
 			}
 		}
-
-		lastModifiedTime, err := lastModifiedTime(client, user, project, pr)
-		if err != nil {
-			glog.Errorf("Failed to get last modified time, skipping PR: %d", *pr.Number)
-			continue
+		return nil
+	case candidateBelowMinPR:
+		glog.V(6).Infof("Dropping %d < %d", prNumber, config.MinPRNumber)
+		return nil
+	case candidateMissingLabels:
+		glog.V(2).Infof("Skipping %d - doesn't have requisite labels", prNumber)
+		return nil
+	case candidateNeedsWhitelist:
+		glog.V(4).Infof("Dropping %d since %s isn't in whitelist and %s isn't present", prNumber, *issue.User.Login, config.WhitelistOverride)
+		if config.DryRun {
+			glog.Infof("PR %d: would have asked for ok-to-merge but DryRun is true", prNumber)
+			return nil
 		}
-		if ok, err := validateLGTMAfterPush(client, user, project, pr, lastModifiedTime); err != nil {
-			glog.Errorf("Error validating LGTM: %v, Skipping: %d", err, *pr.Number)
-			continue
-		} else if !ok {
-			if config.DryRun {
-				glog.Info("PR was pushed after LGTM, would have removed LGTM, but DryRun is true")
-				continue
+		if !HasLabel(issue.Labels, NeedsOKToMergeLabel) {
+			if _, _, err := client.Issues.AddLabelsToIssue(user, project, prNumber, []string{NeedsOKToMergeLabel}); err != nil {
+				glog.Errorf("Failed to set 'needs-ok-to-merge' for %d", prNumber)
 			}
-			glog.Errorf("PR pushed after LGTM, attempting to remove LGTM and skipping")
-			staleLGTMBody := "LGTM was before last commit, removing LGTM"
-			if _, _, err := client.Issues.CreateComment(user, project, *pr.Number, &github.IssueComment{Body: &staleLGTMBody}); err != nil {
-				glog.Warningf("Failed to create remove label comment: %v", err)
+			body := "The author of this PR is not in the whitelist for merge, can one of the admins add the 'ok-to-merge' label?"
+			if _, _, err := client.Issues.CreateComment(user, project, prNumber, &github.IssueComment{Body: &body}); err != nil {
+				glog.Errorf("Failed to add a comment for %d", prNumber)
 			}
-			if _, err := client.Issues.RemoveLabelForIssue(user, project, *pr.Number, "lgtm"); err != nil {
-				glog.Warningf("Failed to remove 'lgtm' label for stale lgtm on %d", *pr.Number)
-			}
-			continue
 		}
+		return nil
+	}
 
-		// This is annoying, github appears to only temporarily cache mergeability, if it is nil, wait
-		// for an async refresh and retry.
-		if pr.Mergeable == nil {
-			glog.Infof("Waiting for mergeability on %s %d", *pr.Title, *pr.Number)
-			// TODO: determine what a good empirical setting for this is.
-			time.Sleep(10 * time.Second)
-			pr, _, err = client.PullRequests.Get(user, project, *pr.Number)
-		}
-		if pr.Mergeable == nil {
-			glog.Errorf("No mergeability information for %s %d, Skipping.", *pr.Title, *pr.Number)
-			continue
-		}
-		if !*pr.Mergeable {
-			glog.V(2).Infof("Skipping %d - not mergable", *pr.Number)
-			continue
+	pr, _, err := client.PullRequests.Get(user, project, prNumber)
+	if err != nil {
+		glog.Errorf("Error getting pull request: %v", err)
+		return nil
+	}
+
+	// Tidy up the issue list.
+	if HasLabel(issue.Labels, NeedsOKToMergeLabel) && !config.DryRun {
+		if _, err := client.Issues.RemoveLabelForIssue(user, project, *pr.Number, NeedsOKToMergeLabel); err != nil {
+			glog.Warningf("Failed to remove 'needs-ok-to-merge' from issue %d, which doesn't need it", *pr.Number)
 		}
+	}
 
-		// Validate the status information for this PR
-		contexts := config.RequiredStatusContexts
-		if len(config.DontRequireE2ELabel) == 0 || !HasLabel(issue.Labels, config.DontRequireE2ELabel) {
-			contexts = append(contexts, config.E2EStatusContext)
+	lastModifiedTime, err := lastModifiedTime(client, user, project, pr)
+	if err != nil {
+		glog.Errorf("Failed to get last modified time, skipping PR: %d", *pr.Number)
+		return nil
+	}
+	if ok, err := validateLGTMAfterPush(client, user, project, pr, lastModifiedTime); err != nil {
+		glog.Errorf("Error validating LGTM: %v, Skipping: %d", err, *pr.Number)
+		return nil
+	} else if !ok {
+		if config.DryRun {
+			glog.Info("PR was pushed after LGTM, would have removed LGTM, but DryRun is true")
+			return nil
 		}
-		ok, err := ValidateStatus(client, user, project, *pr.Number, contexts, false)
-		if err != nil {
-			glog.Errorf("Error validating PR status: %v", err)
-			continue
+		glog.Errorf("PR pushed after LGTM, attempting to remove LGTM and skipping")
+		staleLGTMBody := "LGTM was before last commit, removing LGTM"
+		if _, _, err := client.Issues.CreateComment(user, project, *pr.Number, &github.IssueComment{Body: &staleLGTMBody}); err != nil {
+			glog.Warningf("Failed to create remove label comment: %v", err)
 		}
-		if !ok {
-			continue
+		if _, err := client.Issues.RemoveLabelForIssue(user, project, *pr.Number, "lgtm"); err != nil {
+			glog.Warningf("Failed to remove 'lgtm' label for stale lgtm on %d", *pr.Number)
 		}
-		if err := fn(client, pr, issue); err != nil {
-			glog.Errorf("Failed to run user function: %v", err)
-			break
+		return nil
+	}
+
+	pr, mergeableState, err := waitForMergeableState(client, user, project, pr, config)
+	if err != nil {
+		glog.Errorf("Error refreshing mergeability for %s %d: %v, Skipping.", *pr.Title, *pr.Number, err)
+		return nil
+	}
+	switch mergeableState {
+	case "":
+		glog.Errorf("No mergeability information for %s %d, Skipping.", *pr.Title, *pr.Number)
+		return nil
+	case "clean":
+		// go
+	case "unstable":
+		if !config.AllowUnstableMerge {
+			glog.V(2).Infof("Skipping %d - mergeable state is unstable", *pr.Number)
+			return nil
 		}
-		if once {
-			break
+	case "blocked":
+		glog.V(2).Infof("Skipping %d - mergeable state is blocked", *pr.Number)
+		return nil
+	case "dirty":
+		glog.V(2).Infof("Skipping %d - merge conflict", *pr.Number)
+		if !config.DryRun {
+			body := "merge conflict, please rebase"
+			if _, _, err := client.Issues.CreateComment(user, project, *pr.Number, &github.IssueComment{Body: &body}); err != nil {
+				glog.Errorf("Failed to add a comment for %d", *pr.Number)
+			}
 		}
+		return nil
+	default:
+		glog.V(2).Infof("Skipping %d - unrecognized mergeable state %q", *pr.Number, mergeableState)
+		return nil
 	}
-	return nil
+
+	// Validate the status information for this PR
+	// Copy before appending: config.RequiredStatusContexts is shared across
+	// concurrent webhook/notify/poll goroutines, and appending onto it in
+	// place could race another goroutine doing the same if it has spare
+	// capacity.
+	contexts := append([]string{}, config.RequiredStatusContexts...)
+	if len(config.DontRequireE2ELabel) == 0 || !HasLabel(issue.Labels, config.DontRequireE2ELabel) {
+		contexts = append(contexts, config.E2EStatusContext)
+	}
+	ok, err := ValidateStatus(client, user, project, *pr.Number, contexts, false)
+	if err != nil {
+		glog.Errorf("Error validating PR status: %v", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	if _, err := config.Merge(client, user, project, pr); err != nil {
+		glog.Errorf("Failed to merge %d: %v", *pr.Number, err)
+		return err
+	}
+	return fn(client, pr, issue)
 }
 
 func getCommitStatus(client *github.Client, user, project string, prNumber int) ([]*github.CombinedStatus, error) {
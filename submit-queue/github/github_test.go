@@ -0,0 +1,108 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package github
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestSignAppJWTBackdatesIat(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+	transport := &appInstallationTransport{appID: 1, privateKey: key}
+
+	before := time.Now()
+	signed, err := transport.signAppJWT()
+	if err != nil {
+		t.Fatalf("signAppJWT() returned error: %v", err)
+	}
+	after := time.Now()
+
+	token, err := jwt.Parse(signed, func(*jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to parse signed JWT: %v", err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+
+	iat := int64(claims["iat"].(float64))
+	if iat >= before.Unix() {
+		t.Errorf("iat = %d, want it backdated before signing time %d", iat, before.Unix())
+	}
+	if lag := before.Unix() - iat; lag > 120 {
+		t.Errorf("iat backdated by %ds, want roughly a minute of slack", lag)
+	}
+
+	exp := int64(claims["exp"].(float64))
+	if wantMin, wantMax := before.Add(8*time.Minute).Unix(), after.Add(10*time.Minute).Unix(); exp < wantMin || exp > wantMax {
+		t.Errorf("exp = %d, want within [%d, %d] (~9m from signing time)", exp, wantMin, wantMax)
+	}
+}
+
+func TestBackOffSecondaryLimitGrowsAndCaps(t *testing.T) {
+	r := &RateLimitRoundTripper{}
+	resp := &http.Response{Header: http.Header{}}
+
+	wantWaits := []time.Duration{
+		1 * time.Minute,
+		2 * time.Minute,
+		4 * time.Minute,
+		8 * time.Minute,
+		16 * time.Minute,
+		30 * time.Minute, // capped, would otherwise be 32m
+		30 * time.Minute,
+	}
+	for i, want := range wantWaits {
+		before := time.Now()
+		r.backOffSecondaryLimit(resp)
+		got := r.pausedUnto.Sub(before)
+		if diff := got - want; diff < -time.Second || diff > time.Second {
+			t.Errorf("hit %d: backoff = %v, want ~%v", i+1, got, want)
+		}
+	}
+
+	// RoundTrip resets secondaryLimitHits on any response other than a 403
+	// or a 304; simulate
+	// that happening, then confirm the next hit starts the streak over.
+	r.secondaryLimitHits = 0
+	r.backOffSecondaryLimit(resp)
+	if got, want := r.pausedUnto.Sub(time.Now()), wantWaits[0]; got < want-time.Second || got > want+time.Second {
+		t.Errorf("backoff after reset = %v, want ~%v", got, want)
+	}
+}
+
+func TestBackOffSecondaryLimitHonorsLongerRetryAfter(t *testing.T) {
+	r := &RateLimitRoundTripper{}
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"300"}}} // 5m > the 1m first-hit floor
+
+	before := time.Now()
+	r.backOffSecondaryLimit(resp)
+	got := r.pausedUnto.Sub(before)
+	want := 5 * time.Minute
+	if diff := got - want; diff < -time.Second || diff > time.Second {
+		t.Errorf("backoff = %v, want ~%v (from Retry-After)", got, want)
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package github
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/kubernetes/pkg/util"
+
+	"github.com/golang/glog"
+	"github.com/google/go-github/github"
+)
+
+// NotificationSink receives the grouped message produced by ReportPendingCI.
+// Implementations should treat message as pre-formatted, human-readable text.
+type NotificationSink interface {
+	Notify(message string) error
+}
+
+// StdoutSink writes the message to stdout, useful for local runs and debugging.
+type StdoutSink struct{}
+
+func (StdoutSink) Notify(message string) error {
+	fmt.Println(message)
+	return nil
+}
+
+// SlackSink posts message to a Slack incoming webhook.
+type SlackSink struct {
+	WebhookURL string
+}
+
+func (s SlackSink) Notify(message string) error {
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+	}{Text: message})
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(s.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack webhook returned status %s", resp.Status)
+	}
+	return nil
+}
+
+// WebhookSink posts message as JSON to a generic HTTP endpoint.
+type WebhookSink struct {
+	URL string
+}
+
+func (w WebhookSink) Notify(message string) error {
+	body, err := json.Marshal(struct {
+		Message string `json:"message"`
+	}{Message: message})
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s returned status %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+// pendingPR describes a PR stuck waiting on CI, for the purposes of ReportPendingCI.
+type pendingPR struct {
+	number  int
+	title   string
+	author  string
+	status  string
+	since   *time.Time
+	missing []string
+}
+
+// missingContexts returns the subset of requiredContexts that are not present
+// in statusList, in the same order as requiredContexts.
+func missingContexts(statusList []*github.CombinedStatus, requiredContexts []string) []string {
+	providers := util.StringSet{}
+	for ix := range statusList {
+		for _, subStatus := range statusList[ix].Statuses {
+			providers.Insert(*subStatus.Context)
+		}
+	}
+	var missing []string
+	for _, context := range requiredContexts {
+		if !providers.Has(context) {
+			missing = append(missing, context)
+		}
+	}
+	return missing
+}
+
+// pendingSince returns the earliest CreatedAt among statuses still in the
+// "pending" state, or nil if none are pending.
+func pendingSince(statusList []*github.CombinedStatus) *time.Time {
+	var since *time.Time
+	for ix := range statusList {
+		for _, subStatus := range statusList[ix].Statuses {
+			if subStatus.State == nil || *subStatus.State != "pending" || subStatus.CreatedAt == nil {
+				continue
+			}
+			if since == nil || subStatus.CreatedAt.Before(*since) {
+				since = subStatus.CreatedAt
+			}
+		}
+	}
+	return since
+}
+
+// ReportPendingCI walks candidate PRs the same way ForEachCandidatePRDo does,
+// but instead of merging, it identifies PRs that pass the whitelist/lgtm
+// gates and are stuck waiting on CI -- either missing a required status
+// context entirely ("incomplete") or pending longer than
+// config.StalePendingAfter -- and emits one grouped message describing them
+// through sink.
+func ReportPendingCI(client *github.Client, user, project string, config *FilterConfig, sink NotificationSink) error {
+	issues, err := fetchAllPRsWithLabels(client, user, project, []string{"lgtm", "cla: yes"})
+	if err != nil {
+		return err
+	}
+
+	ensureUserSets(client, user, project, config)
+
+	var pending []pendingPR
+	for ix := range issues {
+		issue := &issues[ix]
+		if gateCandidatePR(issue, config) != candidateOK {
+			continue
+		}
+
+		// Copy before appending: config.RequiredStatusContexts is shared
+		// across concurrent webhook/notify/poll goroutines, and appending
+		// onto it in place could race another goroutine doing the same if
+		// it has spare capacity.
+		contexts := append([]string{}, config.RequiredStatusContexts...)
+		if len(config.DontRequireE2ELabel) == 0 || !HasLabel(issue.Labels, config.DontRequireE2ELabel) {
+			contexts = append(contexts, config.E2EStatusContext)
+		}
+
+		statusList, err := getCommitStatus(client, user, project, *issue.Number)
+		if err != nil {
+			glog.Errorf("Error getting commit status for %d: %v", *issue.Number, err)
+			continue
+		}
+		status := computeStatus(statusList, contexts)
+
+		switch {
+		case status == "incomplete":
+			pending = append(pending, pendingPR{
+				number:  *issue.Number,
+				title:   *issue.Title,
+				author:  *issue.User.Login,
+				status:  status,
+				missing: missingContexts(statusList, contexts),
+			})
+		case status == "pending":
+			since := pendingSince(statusList)
+			if since != nil && time.Since(*since) > config.StalePendingAfter {
+				pending = append(pending, pendingPR{
+					number: *issue.Number,
+					title:  *issue.Title,
+					author: *issue.User.Login,
+					status: status,
+					since:  since,
+				})
+			}
+		}
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+	return sink.Notify(formatPendingReport(pending))
+}
+
+func formatPendingReport(pending []pendingPR) string {
+	var lines []string
+	lines = append(lines, fmt.Sprintf("%d PR(s) stuck waiting on CI:", len(pending)))
+	for _, p := range pending {
+		line := fmt.Sprintf("  #%d %q by %s", p.number, p.title, p.author)
+		switch p.status {
+		case "incomplete":
+			line += fmt.Sprintf(" - missing required contexts: %s", strings.Join(p.missing, ", "))
+		case "pending":
+			line += fmt.Sprintf(" - pending for %s", time.Since(*p.since).Round(time.Minute))
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
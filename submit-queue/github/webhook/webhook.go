@@ -0,0 +1,201 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhook lets the submit queue react to GitHub webhook deliveries
+// instead of (or alongside) polling. It shares its candidate-PR evaluation
+// logic with the polling loop via github.EvaluatePR, so a PR is judged the
+// same way whether it was found by polling or pushed to us by an event.
+//
+// KNOWN GAP: "status" deliveries -- the events GitHub's classic commit-status
+// API fires when CI finishes -- are not dispatched yet (see handledEvents
+// below). A status event only carries a commit SHA, and reacting to it needs
+// a head-SHA-to-open-PR lookup that doesn't exist in this package. "check_run"
+// deliveries, which carry the same CI-finished signal for GitHub Actions and
+// other Checks API integrations, are handled: check_run.pull_requests[] gives
+// us the PR number directly for same-repo PRs, the common case. It's empty
+// for PRs from forks, so those still wait for the next poll, same as a
+// "status" event does today.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/google/go-github/github"
+
+	sqgithub "k8s.io/contrib/submit-queue/github"
+)
+
+// handledEvents are the X-GitHub-Event types that can move a PR through the
+// candidate gate and so are worth re-evaluating on delivery. Other event
+// types are accepted (200) but ignored.
+//
+// "status" deliveries are deliberately not handled here: the payload carries
+// only a commit SHA, and re-evaluating it would need a lookup of open PRs by
+// head SHA that doesn't exist yet. Until that lookup is built, "status"
+// events fall through to the polling loop instead.
+var handledEvents = map[string]bool{
+	"pull_request":        true,
+	"pull_request_review": true,
+	"issue_comment":       true,
+	"check_run":           true,
+}
+
+// NewWebhookServer returns an http.Handler that verifies the
+// X-Hub-Signature-256 HMAC-SHA256 signature GitHub attaches to each
+// delivery using secret, then dispatches the event into the same
+// candidate-evaluation pipeline ForEachCandidatePRDo uses, via fn.
+//
+// client must already be authenticated (e.g. the result of
+// github.MakeClient(token) or github.MakeAppClient(...)) since evaluation
+// can label, comment on, close, or merge PRs along the way, all of which
+// require auth.
+func NewWebhookServer(client *github.Client, secret string, config *sqgithub.FilterConfig, fn sqgithub.PRFunction) http.Handler {
+	return &webhookHandler{
+		secret: []byte(secret),
+		config: config,
+		fn:     fn,
+		client: client,
+	}
+}
+
+type webhookHandler struct {
+	secret []byte
+	config *sqgithub.FilterConfig
+	fn     sqgithub.PRFunction
+	client *github.Client
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	if !validSignature(h.secret, req.Header.Get("X-Hub-Signature-256"), body) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	event := req.Header.Get("X-GitHub-Event")
+	if !handledEvents[event] {
+		glog.V(4).Infof("Ignoring webhook event %q", event)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	owner, repo, prNumbers, err := parsePREvent(event, body)
+	if err != nil {
+		glog.Errorf("Failed to parse %q webhook payload: %v", event, err)
+		http.Error(w, "failed to parse payload", http.StatusBadRequest)
+		return
+	}
+	if len(prNumbers) == 0 {
+		// Event wasn't about a PR we can re-evaluate (e.g. a check_run on a
+		// forked PR, whose pull_requests[] GitHub leaves empty).
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	for _, prNumber := range prNumbers {
+		if err := sqgithub.EvaluatePR(h.client, owner, repo, prNumber, h.config, h.fn); err != nil {
+			glog.Errorf("Failed to evaluate PR %s/%s#%d from webhook: %v", owner, repo, prNumber, err)
+			http.Error(w, "failed to evaluate PR", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// validSignature checks header (the value of X-Hub-Signature-256) against
+// an HMAC-SHA256 of body keyed with secret, per
+// https://docs.github.com/webhooks/securing-your-webhooks
+func validSignature(secret []byte, header string, body []byte) bool {
+	const prefix = "sha256="
+	if len(header) <= len(prefix) || header[:len(prefix)] != prefix {
+		return false
+	}
+	got, err := hex.DecodeString(header[len(prefix):])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// parsePREvent extracts the repository owner/name and the PR number(s) that
+// an event should be re-evaluated against. prNumbers is empty if the payload
+// carries no PR or issue number for the event. Whether that number is an
+// open PR is not checked here: closed PRs are returned too, and for
+// issue_comment so is the number of a plain issue.
+func parsePREvent(event string, body []byte) (owner, repo string, prNumbers []int, err error) {
+	var payload struct {
+		Repository struct {
+			Name  string `json:"name"`
+			Owner struct {
+				Login string `json:"login"`
+			} `json:"owner"`
+		} `json:"repository"`
+		Number int `json:"number"`
+		Issue  struct {
+			Number int `json:"number"`
+		} `json:"issue"`
+		PullRequest struct {
+			Number int `json:"number"`
+		} `json:"pull_request"`
+		CheckRun struct {
+			PullRequests []struct {
+				Number int `json:"number"`
+			} `json:"pull_requests"`
+		} `json:"check_run"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", "", nil, err
+	}
+	owner = payload.Repository.Owner.Login
+	repo = payload.Repository.Name
+
+	switch event {
+	case "pull_request":
+		if payload.Number != 0 {
+			prNumbers = []int{payload.Number}
+		}
+	case "pull_request_review":
+		// pull_request_review payloads have no top-level "number" field,
+		// only pull_request.number.
+		if payload.PullRequest.Number != 0 {
+			prNumbers = []int{payload.PullRequest.Number}
+		}
+	case "issue_comment":
+		if payload.Issue.Number != 0 {
+			prNumbers = []int{payload.Issue.Number}
+		}
+	case "check_run":
+		// check_run.pull_requests[] is only populated for PRs from the same
+		// repo as the check suite; forked PRs leave it empty and fall
+		// through to the polling loop instead.
+		for _, pr := range payload.CheckRun.PullRequests {
+			prNumbers = append(prNumbers, pr.Number)
+		}
+	}
+	return owner, repo, prNumbers, nil
+}
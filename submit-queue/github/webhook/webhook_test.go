@@ -0,0 +1,126 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestValidSignature(t *testing.T) {
+	secret := []byte("sssh")
+	body := []byte(`{"hello":"world"}`)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	validHeader := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	cases := []struct {
+		name   string
+		secret []byte
+		header string
+		body   []byte
+		want   bool
+	}{
+		{"valid", secret, validHeader, body, true},
+		{"wrong secret", []byte("different"), validHeader, body, false},
+		{"tampered body", secret, validHeader, []byte(`{"hello":"moon"}`), false},
+		{"missing prefix", secret, hex.EncodeToString(mac.Sum(nil)), body, false},
+		{"not hex", secret, "sha256=not-hex", body, false},
+		{"empty header", secret, "", body, false},
+	}
+	for _, c := range cases {
+		if got := validSignature(c.secret, c.header, c.body); got != c.want {
+			t.Errorf("%s: validSignature() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParsePREvent(t *testing.T) {
+	const repo = `"repository":{"name":"contrib","owner":{"login":"kubernetes"}}`
+
+	cases := []struct {
+		name          string
+		event         string
+		body          string
+		wantPRNumbers []int
+	}{
+		{
+			name:          "pull_request",
+			event:         "pull_request",
+			body:          `{` + repo + `,"number":42}`,
+			wantPRNumbers: []int{42},
+		},
+		{
+			name:          "pull_request_review",
+			event:         "pull_request_review",
+			body:          `{` + repo + `,"pull_request":{"number":7}}`,
+			wantPRNumbers: []int{7},
+		},
+		{
+			name:          "issue_comment",
+			event:         "issue_comment",
+			body:          `{` + repo + `,"issue":{"number":13}}`,
+			wantPRNumbers: []int{13},
+		},
+		{
+			name:          "issue_comment with no issue number",
+			event:         "issue_comment",
+			body:          `{` + repo + `,"issue":{"number":0}}`,
+			wantPRNumbers: nil,
+		},
+		{
+			name:          "check_run same-repo PR",
+			event:         "check_run",
+			body:          `{` + repo + `,"check_run":{"pull_requests":[{"number":5}]}}`,
+			wantPRNumbers: []int{5},
+		},
+		{
+			name:          "check_run multiple PRs",
+			event:         "check_run",
+			body:          `{` + repo + `,"check_run":{"pull_requests":[{"number":5},{"number":6}]}}`,
+			wantPRNumbers: []int{5, 6},
+		},
+		{
+			name:          "check_run forked PR",
+			event:         "check_run",
+			body:          `{` + repo + `,"check_run":{"pull_requests":[]}}`,
+			wantPRNumbers: nil,
+		},
+	}
+	for _, c := range cases {
+		owner, repoName, prNumbers, err := parsePREvent(c.event, []byte(c.body))
+		if err != nil {
+			t.Errorf("%s: parsePREvent() returned error: %v", c.name, err)
+			continue
+		}
+		if owner != "kubernetes" || repoName != "contrib" {
+			t.Errorf("%s: owner/repo = %q/%q, want kubernetes/contrib", c.name, owner, repoName)
+		}
+		if len(prNumbers) != len(c.wantPRNumbers) {
+			t.Errorf("%s: prNumbers = %v, want %v", c.name, prNumbers, c.wantPRNumbers)
+			continue
+		}
+		for i := range prNumbers {
+			if prNumbers[i] != c.wantPRNumbers[i] {
+				t.Errorf("%s: prNumbers = %v, want %v", c.name, prNumbers, c.wantPRNumbers)
+				break
+			}
+		}
+	}
+}